@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Tor only reads an authorized_clients directory for a service backed by
+// a HiddenServiceDir in its config, never for the ephemeral ADD_ONION
+// services bine's tor.Listen normally creates. So whenever
+// torServer.AuthorizedClients is set, ListenAndServe configures the
+// onion service through a HiddenServiceDir instead, writing the key
+// files Tor expects there itself.
+
+// hsKeyFileHeader is the fixed 32 byte header Tor prefixes its
+// hs_ed25519_secret_key and hs_ed25519_public_key files with.
+func hsKeyFileHeader(kind string) []byte {
+	h := make([]byte, 32)
+	copy(h, "== ed25519v1-"+kind+": type0 ==")
+	return h
+}
+
+// writeHSKeyFiles writes priv into dir using the on-disk layout Tor's
+// HiddenServiceDir expects, so Tor picks up the same key getOrCreatePK
+// already manages instead of minting its own.
+func writeHSKeyFiles(dir string, priv ed25519.PrivateKey) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// Tor stores the "expanded" secret key: SHA-512 of the seed, with
+	// the first half clamped into the scalar and the second half kept
+	// as the signing nonce prefix. This is the same expansion ed25519
+	// itself does internally, just persisted instead of recomputed.
+	seed := priv.Seed()
+	h := sha512.Sum512(seed)
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+
+	secretFile := append(hsKeyFileHeader("secret"), h[:]...)
+	if err := ioutil.WriteFile(filepath.Join(dir, "hs_ed25519_secret_key"), secretFile, 0600); err != nil {
+		return err
+	}
+
+	pub, ok := priv.Public().(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("invalid public key type %T", priv.Public())
+	}
+	publicFile := append(hsKeyFileHeader("public"), pub...)
+	return ioutil.WriteFile(filepath.Join(dir, "hs_ed25519_public_key"), publicFile, 0600)
+}
+
+// waitHostname polls path until Tor has written the service's hostname
+// file, which only happens once the descriptor is ready to publish.
+func waitHostname(ctx context.Context, path string) (string, error) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if d, err := ioutil.ReadFile(path); err == nil && len(d) > 0 {
+			return strings.TrimSpace(string(d)), nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
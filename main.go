@@ -11,9 +11,13 @@ import (
 	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/clementauger/tor-prebuilt/embedded"
@@ -21,16 +25,52 @@ import (
 	"github.com/cretz/bine/torutil"
 	tued25519 "github.com/cretz/bine/torutil/ed25519"
 	"github.com/gorilla/handlers"
+	"golang.org/x/sync/errgroup"
 )
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "mine" {
+		runMine(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "gen-client-auth" {
+		runGenClientAuth(os.Args[2:])
+		return
+	}
+
 	var pkpath string
+	var keyBackend string
+	var singleHop bool
+	var iUnderstand bool
+	var extraArgs stringSliceFlag
+	var httpAddr string
+	var clientAuthDir string
+	var clientAuthKeys stringSliceFlag
 	flag.StringVar(&pkpath, "pk", "onion.pk", "ed25519 pem encoded privatekey file path")
+	flag.StringVar(&keyBackend, "key-backend", "file", "where to store the onion service private key: file, mem or encrypted")
+	flag.BoolVar(&singleHop, "single-hop", false, "run the onion service in non-anonymous single-hop mode, trading server-side anonymity for lower latency")
+	flag.BoolVar(&iUnderstand, "i-understand-non-anonymous", false, "required alongside -single-hop to confirm you understand the loss of server-side anonymity")
+	flag.Var(&extraArgs, "tor-arg", "extra argument passed through to the tor process config, can be repeated")
+	flag.StringVar(&httpAddr, "http", "", "also serve the handler on this clearnet address, e.g. :9090 (disabled when empty)")
+	flag.StringVar(&clientAuthDir, "client-auth-dir", "", "directory of .auth files generated by gen-client-auth to restrict the onion service to (disabled when empty)")
+	flag.Var(&clientAuthKeys, "client-auth-key", "base32 encoded x25519 public key to authorize, can be repeated")
 	flag.Parse()
 
+	if singleHop && !iUnderstand {
+		log.Fatal("-single-hop requires -i-understand-non-anonymous: this mode removes your server's anonymity")
+	}
+	if singleHop {
+		log.Println("WARNING: -single-hop is set, this onion service runs non-anonymously and no longer hides the server's location")
+	}
+
+	store, err := newOnionStore(keyBackend, pkpath)
+	if err != nil {
+		log.Fatalf("invalid -key-backend: %v", err)
+	}
+
 	var tpl *template.Template
-	tpl, err := template.New("").Parse(`welcome to the tor network!`)
+	tpl, err = template.New("").Parse(`welcome to the tor network!`)
 	if _, e := os.Stat("index.tpl"); os.IsNotExist(e) == false {
 		tpl, err = template.ParseFiles("index.tpl")
 	}
@@ -51,37 +91,72 @@ func main() {
 
 	h := handlers.LoggingHandler(os.Stdout, http.HandlerFunc(helloTor))
 
-	var server serverListener
-	if build == "dev" {
-		server = &http.Server{
-			Addr:    ":9090",
+	detector := &torDetector{}
+	ts := &torServer{
+		Store:             store,
+		Handler:           h,
+		SingleHop:         singleHop,
+		ExtraArgs:         extraArgs,
+		AuthorizedClients: ClientAuth{Dir: clientAuthDir, Keys: clientAuthKeys},
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	g, gctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		return ts.ListenAndServe(gctx, detector)
+	})
+
+	if httpAddr != "" {
+		clearnet := &http.Server{
+			Addr:    httpAddr,
 			Handler: h,
 		}
-		log.Println("http://127.0.0.1:9090/")
-	} else {
-		server = &torServer{
-			PrivateKey: pkpath,
-			Handler:    h,
-		}
+		g.Go(func() error {
+			<-gctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			return clearnet.Shutdown(shutdownCtx)
+		})
+		g.Go(func() error {
+			log.Printf("http://%s/\n", httpAddr)
+			if err := clearnet.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		})
 	}
 
-	errc := make(chan error)
-	go func() {
-		errc <- server.ListenAndServe()
-	}()
-
-	sc := make(chan os.Signal)
-	signal.Notify(sc)
-	select {
-	case err := <-errc:
+	if err := g.Wait(); err != nil {
 		log.Println(err)
-	case <-sc:
 	}
 }
 
-func getOrCreatePK(fpath string) (ed25519.PrivateKey, error) {
+// newOnionStore builds the OnionStore selected by the -key-backend flag.
+func newOnionStore(backend, pkpath string) (OnionStore, error) {
+	switch backend {
+	case "file":
+		return NewOnionFile(pkpath, 0600), nil
+	case "mem":
+		return NewOnionMem(), nil
+	case "encrypted":
+		passphrase := func() (string, error) {
+			return promptPassphrase(fmt.Sprintf("passphrase for %s: ", pkpath))
+		}
+		return NewOnionEncryptedFile(pkpath, 0600, passphrase), nil
+	default:
+		return nil, fmt.Errorf("unknown key backend %q, want file, mem or encrypted", backend)
+	}
+}
+
+// getOrCreatePK loads the onion service private key from store, generating
+// and persisting a new one the first time it is called.
+func getOrCreatePK(store OnionStore) (ed25519.PrivateKey, error) {
 	var privateKey ed25519.PrivateKey
-	if _, err := os.Stat(fpath); os.IsNotExist(err) {
+	d, err := store.PrivateKey(onionKeyVersion)
+	if err == ErrNoPrivateKey {
 		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
 		if err != nil {
 			return nil, err
@@ -91,56 +166,116 @@ func getOrCreatePK(fpath string) (ed25519.PrivateKey, error) {
 			return nil, err
 		}
 		pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "ED25519 PRIVATE KEY", Bytes: x509Encoded})
-		ioutil.WriteFile(fpath, pemEncoded, os.ModePerm)
-	} else {
-		d, _ := ioutil.ReadFile(fpath)
-		block, _ := pem.Decode(d)
-		x509Encoded := block.Bytes
-		tPk, err := x509.ParsePKCS8PrivateKey(x509Encoded)
-		if err != nil {
+		if err := store.StorePrivateKey(onionKeyVersion, pemEncoded); err != nil {
 			return nil, err
 		}
-		if x, ok := tPk.(ed25519.PrivateKey); ok {
-			privateKey = x
-		} else {
-			return nil, fmt.Errorf("invalid key type %T wanted ed25519.PrivateKey", tPk)
-		}
+		return privateKey, nil
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(d)
+	x509Encoded := block.Bytes
+	tPk, err := x509.ParsePKCS8PrivateKey(x509Encoded)
+	if err != nil {
+		return nil, err
+	}
+	if x, ok := tPk.(ed25519.PrivateKey); ok {
+		privateKey = x
+	} else {
+		return nil, fmt.Errorf("invalid key type %T wanted ed25519.PrivateKey", tPk)
 	}
 	return privateKey, nil
 }
 
-type serverListener interface {
-	ListenAndServe() error
-}
-
 type torServer struct {
 	Handler http.Handler
-	// PrivateKey path to a pem encoded ed25519 private key
-	PrivateKey string
+	// Store loads and persists the onion service private key and must be
+	// set; it has no default. main uses a plain PEM file unless
+	// -key-backend selects another, and it can be swapped for an
+	// encrypted file, an in-memory store, or a KMS/HSM backed
+	// implementation.
+	Store OnionStore
+	// AuthorizedClients, when set, restricts the onion service to the
+	// listed v3 client auth keys instead of publishing it to everyone.
+	AuthorizedClients ClientAuth
+	// SingleHop runs the service in Tor's non-anonymous single-hop
+	// mode, trading the server's anonymity for lower latency.
+	SingleHop bool
+	// ExtraArgs are passed through verbatim to the tor process config.
+	ExtraArgs []string
+}
+
+// stringSliceFlag implements flag.Value for a repeatable string flag.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringSliceFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
 }
 
 func onion(pk ed25519.PrivateKey) string {
 	return torutil.OnionServiceIDFromV3PublicKey(tued25519.PublicKey([]byte(pk.Public().(ed25519.PublicKey))))
 }
 
-func (ts *torServer) ListenAndServe() error {
+// ListenAndServe starts the embedded tor process, publishes the onion
+// service and serves ts.Handler on it until ctx is canceled, at which
+// point it shuts the http server down before closing the onion listener
+// and the tor process, in that order.
+func (ts *torServer) ListenAndServe(ctx context.Context, detector *torDetector) error {
 
-	pk, err := getOrCreatePK(ts.PrivateKey)
+	pk, err := getOrCreatePK(ts.Store)
 	if err != nil {
 		return err
 	}
 
-	d, _ := ioutil.TempDir("", "data-dir")
+	d, err := ioutil.TempDir("", "data-dir")
 	if err != nil {
 		return err
 	}
 
+	extraArgs := append([]string{}, ts.ExtraArgs...)
+	if ts.SingleHop {
+		extraArgs = append(extraArgs, "--HiddenServiceSingleHopMode", "1", "--HiddenServiceNonAnonymousMode", "1")
+	}
+
+	// Tor only ever reads an authorized_clients directory for a service
+	// declared through a HiddenServiceDir, never for the ephemeral
+	// ADD_ONION services Listen otherwise creates below. So client auth
+	// forces that mode instead, with pk written in the on-disk format
+	// Tor expects and a plain local listener behind HiddenServicePort.
+	hasClientAuth := ts.AuthorizedClients.Dir != "" || len(ts.AuthorizedClients.Keys) > 0
+	var localLn net.Listener
+	var serviceDir string
+	if hasClientAuth {
+		serviceDir = filepath.Join(d, "onion-service")
+		if err := writeHSKeyFiles(serviceDir, pk); err != nil {
+			return fmt.Errorf("unable to write onion service key files: %v", err)
+		}
+		if err := writeAuthorizedClients(filepath.Join(serviceDir, "authorized_clients"), ts.AuthorizedClients); err != nil {
+			return fmt.Errorf("unable to write authorized clients: %v", err)
+		}
+		localLn, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		defer localLn.Close()
+		_, port, _ := net.SplitHostPort(localLn.Addr().String())
+		extraArgs = append(extraArgs,
+			"--HiddenServiceDir", serviceDir,
+			"--HiddenServiceVersion", "3",
+			"--HiddenServicePort", "80 127.0.0.1:"+port,
+		)
+	}
+
 	// Start tor with default config (can set start conf's DebugWriter to os.Stdout for debug logs)
 	fmt.Println("Starting and registering onion service, please wait a couple of minutes...")
 	t, err := tor.Start(nil, &tor.StartConf{
 		DataDir:        d,
 		ProcessCreator: embedded.NewCreator(),
 		NoHush:         true,
+		ExtraArgs:      extraArgs,
 	})
 	if err != nil {
 		return fmt.Errorf("unable to start Tor: %v", err)
@@ -148,16 +283,49 @@ func (ts *torServer) ListenAndServe() error {
 	defer t.Close()
 
 	// Wait at most a few minutes to publish the service
-	listenCtx, listenCancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	listenCtx, listenCancel := context.WithTimeout(ctx, 3*time.Minute)
 	defer listenCancel()
-	// Create a v3 onion service to listen on any port but show as 80
-	onion, err := t.Listen(listenCtx, &tor.ListenConf{Key: pk, Version3: true, RemotePorts: []int{80}})
-	if err != nil {
-		return fmt.Errorf("unable to create onion service: %v", err)
+
+	var ln net.Listener
+	var onionID string
+	if hasClientAuth {
+		hostname, err := waitHostname(listenCtx, filepath.Join(serviceDir, "hostname"))
+		if err != nil {
+			return fmt.Errorf("unable to read onion service hostname: %v", err)
+		}
+		onionID = strings.TrimSuffix(hostname, ".onion")
+		ln = localLn
+	} else {
+		// Create a v3 onion service to listen on any port but show as 80
+		onion, err := t.Listen(listenCtx, &tor.ListenConf{Key: pk, Version3: true, RemotePorts: []int{80}, NonAnonymous: ts.SingleHop})
+		if err != nil {
+			return fmt.Errorf("unable to create onion service: %v", err)
+		}
+		defer onion.Close()
+		onionID = onion.ID
+		ln = onion
 	}
-	defer onion.Close()
 
-	fmt.Printf("server listening at http://%v.onion\n", onion.ID)
+	fmt.Printf("server listening at http://%v.onion\n", onionID)
 
-	return http.Serve(onion, ts.Handler)
+	srv := &http.Server{
+		Handler:     ts.Handler,
+		ConnContext: detector.connContext,
+	}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	// Serve returns as soon as Shutdown begins; wait for it to finish
+	// before the deferred onion listener and tor Close calls run.
+	<-shutdownDone
+	return nil
 }
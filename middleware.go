@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// torUsedKeyType is the context key type used to mark tor-originated
+// requests. It is unexported so only IsTor and torDetector can set or
+// read it.
+type torUsedKeyType struct{}
+
+var torUsedKey torUsedKeyType
+
+// IsTor reports whether r arrived through the onion service listener
+// rather than a clearnet one, so handlers and templates can render
+// .onion links, disable third-party embeds, or skip analytics for Tor
+// visitors.
+func IsTor(r *http.Request) bool {
+	used, _ := r.Context().Value(torUsedKey).(bool)
+	return used
+}
+
+// torDetector tags every connection accepted on the onion listener as
+// tor-originated. Wire connContext as the ConnContext of the http.Server
+// serving the onion listener; a clearnet server should leave ConnContext
+// unset so its requests report IsTor false.
+type torDetector struct{}
+
+func (d *torDetector) connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, torUsedKey, true)
+}
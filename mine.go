@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// v3Alphabet matches the base32 alphabet used by v3 onion addresses.
+var v3Alphabet = regexp.MustCompile(`^[a-z2-7]+$`)
+
+// runMine implements the `hello-tor mine` subcommand: it searches for an
+// ed25519 keypair whose v3 onion address starts with the requested
+// prefix, then writes the winning key in the same PEM format
+// getOrCreatePK already reads, so it can be reused transparently with
+// `-pk` on the next run.
+func runMine(args []string) {
+	fs := flag.NewFlagSet("mine", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "desired onion address prefix, using the v3 base32 alphabet a-z2-7")
+	workers := fs.Int("workers", runtime.GOMAXPROCS(0), "number of parallel search goroutines")
+	out := fs.String("out", "onion.pk", "path to write the winning ed25519 pem encoded privatekey file")
+	fs.Parse(args)
+
+	p := strings.ToLower(*prefix)
+	if p == "" {
+		fmt.Fprintln(os.Stderr, "mine: -prefix is required")
+		os.Exit(1)
+	}
+	if !v3Alphabet.MatchString(p) {
+		fmt.Fprintf(os.Stderr, "mine: -prefix %q must only use the v3 base32 alphabet a-z2-7\n", *prefix)
+		os.Exit(1)
+	}
+	if *workers <= 0 {
+		fmt.Fprintf(os.Stderr, "mine: -workers must be positive, got %d\n", *workers)
+		os.Exit(1)
+	}
+
+	expected := math.Pow(32, float64(len(p)))
+	fmt.Printf("mining a v3 onion address starting with %q across %d workers (expect ~%.0f attempts)...\n", p, *workers, expected)
+
+	var attempts uint64
+	start := time.Now()
+	found := make(chan ed25519.PrivateKey, 1)
+	done := make(chan struct{})
+
+	for i := 0; i < *workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_, pk, err := ed25519.GenerateKey(rand.Reader)
+				if err != nil {
+					continue
+				}
+				atomic.AddUint64(&attempts, 1)
+				if strings.HasPrefix(onion(pk), p) {
+					select {
+					case found <- pk:
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var pk ed25519.PrivateKey
+loop:
+	for {
+		select {
+		case pk = <-found:
+			break loop
+		case <-ticker.C:
+			n := atomic.LoadUint64(&attempts)
+			rate := float64(n) / time.Since(start).Seconds()
+			eta := time.Duration(expected / rate * float64(time.Second))
+			fmt.Printf("%d attempts, %.0f/s, ~%s left at this rate\n", n, rate, eta)
+		}
+	}
+	close(done)
+
+	n := atomic.LoadUint64(&attempts)
+	fmt.Printf("found %v.onion after %d attempts in %s\n", onion(pk), n, time.Since(start))
+
+	x509Encoded, err := x509.MarshalPKCS8PrivateKey(pk)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mine: %v\n", err)
+		os.Exit(1)
+	}
+	pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "ED25519 PRIVATE KEY", Bytes: x509Encoded})
+	if err := ioutil.WriteFile(*out, pemEncoded, os.ModePerm); err != nil {
+		fmt.Fprintf(os.Stderr, "mine: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("private key written to %s, start hello-tor with -pk %s to use it\n", *out, *out)
+}
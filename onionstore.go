@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"filippo.io/age"
+	"golang.org/x/term"
+)
+
+// onionKeyVersion identifies the onion service key hello-tor manages.
+// Today only v3 onion services are supported, but the version is kept
+// as an explicit parameter so stores can hold more than one key side by
+// side if v2 support ever comes back.
+const onionKeyVersion = 3
+
+// ErrNoPrivateKey is returned by an OnionStore when no key has been
+// persisted yet for the requested version.
+var ErrNoPrivateKey = errors.New("hello-tor: no private key stored for this version")
+
+// OnionStore persists the private key backing a tor onion service. It is
+// the extension point that lets hello-tor be embedded as a library: the
+// default implementation keeps a PEM file next to the binary, but a
+// deployment can swap in an encrypted file, a KMS/HSM wrapper, or
+// anything else that can produce and store raw key bytes.
+type OnionStore interface {
+	// StorePrivateKey persists key for the given onion service version,
+	// overwriting any previously stored key.
+	StorePrivateKey(version int, key []byte) error
+	// PrivateKey returns the key previously stored for the given onion
+	// service version, or ErrNoPrivateKey if none was stored yet.
+	PrivateKey(version int) ([]byte, error)
+	// DeletePrivateKey removes the key stored for the given onion
+	// service version, if any. It is not an error to delete a key that
+	// was never stored.
+	DeletePrivateKey(version int) error
+}
+
+// OnionFile is an OnionStore backed by a single file on disk, holding
+// the PEM encoded key exactly as hello-tor always wrote it.
+type OnionFile struct {
+	path string
+	perm os.FileMode
+}
+
+// NewOnionFile returns an OnionStore that reads and writes its key at
+// path, creating it with the given permissions.
+func NewOnionFile(path string, perm os.FileMode) *OnionFile {
+	return &OnionFile{path: path, perm: perm}
+}
+
+func (o *OnionFile) StorePrivateKey(version int, key []byte) error {
+	return ioutil.WriteFile(o.path, key, o.perm)
+}
+
+func (o *OnionFile) PrivateKey(version int) ([]byte, error) {
+	if _, err := os.Stat(o.path); os.IsNotExist(err) {
+		return nil, ErrNoPrivateKey
+	}
+	return ioutil.ReadFile(o.path)
+}
+
+func (o *OnionFile) DeletePrivateKey(version int) error {
+	if _, err := os.Stat(o.path); os.IsNotExist(err) {
+		return nil
+	}
+	return os.Remove(o.path)
+}
+
+// OnionMem is an in-memory OnionStore. It never touches disk, which
+// makes it convenient for tests and for short-lived services that are
+// fine regenerating a new onion address on every restart.
+type OnionMem struct {
+	keys map[int][]byte
+}
+
+// NewOnionMem returns an empty in-memory OnionStore.
+func NewOnionMem() *OnionMem {
+	return &OnionMem{keys: map[int][]byte{}}
+}
+
+func (o *OnionMem) StorePrivateKey(version int, key []byte) error {
+	o.keys[version] = key
+	return nil
+}
+
+func (o *OnionMem) PrivateKey(version int) ([]byte, error) {
+	k, ok := o.keys[version]
+	if !ok {
+		return nil, ErrNoPrivateKey
+	}
+	return k, nil
+}
+
+func (o *OnionMem) DeletePrivateKey(version int) error {
+	delete(o.keys, version)
+	return nil
+}
+
+// OnionEncryptedFile is an OnionStore that keeps the key on disk
+// encrypted with a passphrase, using age's scrypt recipient so no key
+// material is ever written in plaintext. Passphrase is called lazily,
+// once per operation, so the caller can prompt on a terminal the first
+// time a key is needed rather than upfront.
+type OnionEncryptedFile struct {
+	path       string
+	perm       os.FileMode
+	passphrase func() (string, error)
+}
+
+// NewOnionEncryptedFile returns an OnionStore storing its key encrypted
+// at path. passphrase is invoked every time the key must be read or
+// written.
+func NewOnionEncryptedFile(path string, perm os.FileMode, passphrase func() (string, error)) *OnionEncryptedFile {
+	return &OnionEncryptedFile{path: path, perm: perm, passphrase: passphrase}
+}
+
+func (o *OnionEncryptedFile) StorePrivateKey(version int, key []byte) error {
+	pass, err := o.passphrase()
+	if err != nil {
+		return err
+	}
+	r, err := age.NewScryptRecipient(pass)
+	if err != nil {
+		return fmt.Errorf("building age recipient: %v", err)
+	}
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, r)
+	if err != nil {
+		return fmt.Errorf("encrypting private key: %v", err)
+	}
+	if _, err := w.Write(key); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(o.path, buf.Bytes(), o.perm)
+}
+
+func (o *OnionEncryptedFile) PrivateKey(version int) ([]byte, error) {
+	if _, err := os.Stat(o.path); os.IsNotExist(err) {
+		return nil, ErrNoPrivateKey
+	}
+	enc, err := ioutil.ReadFile(o.path)
+	if err != nil {
+		return nil, err
+	}
+	pass, err := o.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	id, err := age.NewScryptIdentity(pass)
+	if err != nil {
+		return nil, fmt.Errorf("building age identity: %v", err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(enc), id)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting private key: %v", err)
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (o *OnionEncryptedFile) DeletePrivateKey(version int) error {
+	if _, err := os.Stat(o.path); os.IsNotExist(err) {
+		return nil
+	}
+	return os.Remove(o.path)
+}
+
+// promptPassphrase prints prompt and reads a passphrase from the
+// terminal without echoing it back. It is the default passphrase
+// callback wired into OnionEncryptedFile from main.
+func promptPassphrase(prompt string) (string, error) {
+	fmt.Print(prompt)
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
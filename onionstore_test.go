@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOnionMemRoundTrip(t *testing.T) {
+	store := NewOnionMem()
+
+	if _, err := store.PrivateKey(onionKeyVersion); err != ErrNoPrivateKey {
+		t.Fatalf("PrivateKey on empty store = %v, want ErrNoPrivateKey", err)
+	}
+
+	want := []byte("fake private key bytes")
+	if err := store.StorePrivateKey(onionKeyVersion, want); err != nil {
+		t.Fatalf("StorePrivateKey: %v", err)
+	}
+
+	got, err := store.PrivateKey(onionKeyVersion)
+	if err != nil {
+		t.Fatalf("PrivateKey: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("PrivateKey = %q, want %q", got, want)
+	}
+
+	if err := store.DeletePrivateKey(onionKeyVersion); err != nil {
+		t.Fatalf("DeletePrivateKey: %v", err)
+	}
+	if _, err := store.PrivateKey(onionKeyVersion); err != ErrNoPrivateKey {
+		t.Fatalf("PrivateKey after delete = %v, want ErrNoPrivateKey", err)
+	}
+}
+
+func TestGetOrCreatePK(t *testing.T) {
+	store := NewOnionMem()
+
+	pk1, err := getOrCreatePK(store)
+	if err != nil {
+		t.Fatalf("getOrCreatePK: %v", err)
+	}
+
+	pk2, err := getOrCreatePK(store)
+	if err != nil {
+		t.Fatalf("getOrCreatePK on existing key: %v", err)
+	}
+
+	if !bytes.Equal(pk1, pk2) {
+		t.Fatalf("getOrCreatePK returned a different key on the second call")
+	}
+}